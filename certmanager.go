@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	certValidity = 365 * 24 * time.Hour
+	rotateBefore = 30 * 24 * time.Hour
+
+	tlsSecretCrtKey = "tls.crt"
+	tlsSecretKeyKey = "tls.key"
+	tlsSecretCAKey  = "ca.crt"
+)
+
+// CertManager self-provisions and rotates the webhook's serving certificate
+// in-cluster, so simple deployments don't need an external cert-manager or
+// kube-webhook-certgen setup.
+type CertManager struct {
+	clientset kubernetes.Interface
+
+	secretName      string
+	secretNamespace string
+	serviceName     string
+	webhookName     string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func NewCertManager(clientset kubernetes.Interface, secretNamespace, secretName, serviceName, webhookName string) *CertManager {
+	return &CertManager{
+		clientset:       clientset,
+		secretName:      secretName,
+		secretNamespace: secretNamespace,
+		serviceName:     serviceName,
+		webhookName:     webhookName,
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate, always serving the
+// most recently loaded or rotated certificate.
+func (m *CertManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.cert == nil {
+		return nil, fmt.Errorf("no webhook certificate loaded yet")
+	}
+	return m.cert, nil
+}
+
+// Bootstrap loads the serving certificate from its Secret, generating a new
+// self-signed CA and cert if none exists yet or the existing one is due for
+// rotation, and patches the MutatingWebhookConfiguration's CABundle so the
+// API server trusts it. The CABundle patch runs before this process swaps
+// over to the new certificate, so a failed patch never leaves the webhook
+// serving material the API server doesn't recognize yet.
+func (m *CertManager) Bootstrap(ctx context.Context) error {
+	secret, err := m.clientset.CoreV1().Secrets(m.secretNamespace).Get(ctx, m.secretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		secret, err = m.provision(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("while fetching cert secret: %w", err)
+	}
+
+	cert, err := m.parseCert(secret)
+	if err != nil {
+		return err
+	}
+
+	if certDueForRotation(&cert) {
+		secret, err = m.provision(ctx)
+		if err != nil {
+			return err
+		}
+		cert, err = m.parseCert(secret)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := m.patchWebhookCABundle(ctx, secret.Data[tlsSecretCAKey]); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.cert = &cert
+	m.mu.Unlock()
+	return nil
+}
+
+// RunRotator blocks, re-running Bootstrap shortly before the current
+// certificate expires so the HTTPS server picks up new material via
+// GetCertificate without a restart. It returns when ctx is done.
+func (m *CertManager) RunRotator(ctx context.Context) {
+	for {
+		wait := m.timeUntilRotation()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		if err := m.Bootstrap(ctx); err != nil {
+			log.Errorf("while rotating webhook certificate: %v", err)
+		}
+	}
+}
+
+func (m *CertManager) timeUntilRotation() time.Duration {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.cert == nil || len(m.cert.Certificate) == 0 {
+		return time.Minute
+	}
+
+	leaf, err := x509.ParseCertificate(m.cert.Certificate[0])
+	if err != nil {
+		return time.Minute
+	}
+
+	wait := time.Until(leaf.NotAfter.Add(-rotateBefore))
+	if wait <= 0 {
+		return time.Minute
+	}
+	return wait
+}
+
+func (m *CertManager) dueForRotation() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return certDueForRotation(m.cert)
+}
+
+// certDueForRotation reports whether cert is nil, unparsable, or within
+// rotateBefore of expiring.
+func certDueForRotation(cert *tls.Certificate) bool {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return true
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return true
+	}
+
+	return time.Now().After(leaf.NotAfter.Add(-rotateBefore))
+}
+
+// parseCert parses the cert/key pair from secret without touching m.cert, so
+// Bootstrap can decide whether freshly fetched material is due for rotation
+// before committing to serve it.
+func (m *CertManager) parseCert(secret *corev1.Secret) (tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(secret.Data[tlsSecretCrtKey], secret.Data[tlsSecretKeyKey])
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("while parsing cert/key from secret %s/%s: %w", m.secretNamespace, m.secretName, err)
+	}
+	return cert, nil
+}
+
+// provision generates a fresh self-signed CA and serving cert and stores
+// them in the cert Secret, creating it if it doesn't exist yet.
+func (m *CertManager) provision(ctx context.Context) (*corev1.Secret, error) {
+	caCert, caKey, err := generateSelfSignedCA()
+	if err != nil {
+		return nil, fmt.Errorf("while generating CA: %w", err)
+	}
+
+	dnsNames := []string{
+		fmt.Sprintf("%s.%s.svc", m.serviceName, m.secretNamespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", m.serviceName, m.secretNamespace),
+	}
+
+	certPEM, keyPEM, err := generateServingCert(caCert, caKey, dnsNames)
+	if err != nil {
+		return nil, fmt.Errorf("while generating serving cert: %w", err)
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      m.secretName,
+			Namespace: m.secretNamespace,
+		},
+		Type: corev1.SecretTypeTLS,
+		Data: map[string][]byte{
+			tlsSecretCrtKey: certPEM,
+			tlsSecretKeyKey: keyPEM,
+			tlsSecretCAKey:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}),
+		},
+	}
+
+	secrets := m.clientset.CoreV1().Secrets(m.secretNamespace)
+	existing, err := secrets.Get(ctx, m.secretName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return secrets.Create(ctx, secret, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return nil, fmt.Errorf("while checking for existing cert secret: %w", err)
+	}
+
+	existing.Type = secret.Type
+	existing.Data = secret.Data
+	return secrets.Update(ctx, existing, metav1.UpdateOptions{})
+}
+
+func (m *CertManager) patchWebhookCABundle(ctx context.Context, caBundle []byte) error {
+	webhooks := m.clientset.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	webhookConfig, err := webhooks.Get(ctx, m.webhookName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("while fetching MutatingWebhookConfiguration %q: %w", m.webhookName, err)
+	}
+
+	for i := range webhookConfig.Webhooks {
+		webhookConfig.Webhooks[i].ClientConfig.CABundle = caBundle
+	}
+
+	if _, err := webhooks.Update(ctx, webhookConfig, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("while patching MutatingWebhookConfiguration %q caBundle: %w", m.webhookName, err)
+	}
+	return nil
+}
+
+func generateSelfSignedCA() (*x509.Certificate, *rsa.PrivateKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "remaw-webhook-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(certValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cert, key, nil
+}
+
+func generateServingCert(caCert *x509.Certificate, caKey *rsa.PrivateKey, dnsNames []string) (certPEM, keyPEM []byte, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(certValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	return certPEM, keyPEM, nil
+}
+
+func randomSerial() (*big.Int, error) {
+	limit := new(big.Int).Lsh(big.NewInt(1), 128)
+	return rand.Int(rand.Reader, limit)
+}
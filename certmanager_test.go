@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const (
+	testSecretNamespace   = "remaw-system"
+	testSecretName        = "remaw-webhook-tls"
+	testServiceName       = "remaw-webhook"
+	testWebhookConfigName = "remaw-webhook"
+)
+
+func newTestCertManager(t *testing.T) (*CertManager, *fake.Clientset) {
+	t.Helper()
+
+	webhookConfig := &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: testWebhookConfigName},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{
+			{Name: "mutate.remaw.nais.io"},
+		},
+	}
+
+	clientset := fake.NewSimpleClientset(webhookConfig)
+	manager := NewCertManager(clientset, testSecretNamespace, testSecretName, testServiceName, testWebhookConfigName)
+	return manager, clientset
+}
+
+func TestCertManagerBootstrapProvisionsAndLoadsCert(t *testing.T) {
+	manager, clientset := newTestCertManager(t)
+
+	if err := manager.Bootstrap(context.Background()); err != nil {
+		t.Fatalf("Bootstrap: %v", err)
+	}
+
+	if _, err := manager.GetCertificate(nil); err != nil {
+		t.Fatalf("GetCertificate: %v", err)
+	}
+
+	secret, err := clientset.CoreV1().Secrets(testSecretNamespace).Get(context.Background(), testSecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("fetching provisioned secret: %v", err)
+	}
+	if len(secret.Data[tlsSecretCrtKey]) == 0 || len(secret.Data[tlsSecretKeyKey]) == 0 || len(secret.Data[tlsSecretCAKey]) == 0 {
+		t.Fatalf("expected provisioned secret to carry cert, key and CA data")
+	}
+
+	webhookConfig, err := clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.Background(), testWebhookConfigName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("fetching webhook config: %v", err)
+	}
+	for i, webhook := range webhookConfig.Webhooks {
+		if len(webhook.ClientConfig.CABundle) == 0 {
+			t.Fatalf("expected webhook %d to have its CABundle patched", i)
+		}
+	}
+}
+
+func TestCertManagerBootstrapReusesUnexpiredCert(t *testing.T) {
+	manager, clientset := newTestCertManager(t)
+
+	if err := manager.Bootstrap(context.Background()); err != nil {
+		t.Fatalf("first Bootstrap: %v", err)
+	}
+	first, err := clientset.CoreV1().Secrets(testSecretNamespace).Get(context.Background(), testSecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("fetching secret after first Bootstrap: %v", err)
+	}
+
+	if err := manager.Bootstrap(context.Background()); err != nil {
+		t.Fatalf("second Bootstrap: %v", err)
+	}
+	second, err := clientset.CoreV1().Secrets(testSecretNamespace).Get(context.Background(), testSecretName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("fetching secret after second Bootstrap: %v", err)
+	}
+
+	if string(first.Data[tlsSecretCrtKey]) != string(second.Data[tlsSecretCrtKey]) {
+		t.Fatalf("expected Bootstrap to reuse the existing, unexpired certificate rather than rotating it")
+	}
+}
+
+func TestCertManagerBootstrapDoesNotSwapCertWhenCABundlePatchFails(t *testing.T) {
+	clientset := fake.NewSimpleClientset()
+	manager := NewCertManager(clientset, testSecretNamespace, testSecretName, testServiceName, testWebhookConfigName)
+
+	if err := manager.Bootstrap(context.Background()); err == nil {
+		t.Fatalf("expected Bootstrap to fail when the MutatingWebhookConfiguration doesn't exist")
+	}
+
+	if _, err := manager.GetCertificate(nil); err == nil {
+		t.Fatalf("expected no certificate to be loaded after a failed CABundle patch")
+	}
+}
+
+func TestCertManagerDueForRotationWithNoCert(t *testing.T) {
+	manager := &CertManager{}
+
+	if !manager.dueForRotation() {
+		t.Fatalf("expected a CertManager with no loaded cert to be due for rotation")
+	}
+}
@@ -1,17 +1,31 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"remaw/pkg/metrics"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
+// drainDelay is how long the isReady probe reports unhealthy before the
+// server starts shutting down, giving the API server time to notice and
+// stop sending new AdmissionReviews.
+const drainDelay = 5 * time.Second
+
+// shutdownTimeout bounds how long Shutdown waits for in-flight requests to
+// finish before giving up.
+const shutdownTimeout = 30 * time.Second
+
 func textFormatter() log.Formatter {
 	return &log.TextFormatter{
 		DisableTimestamp: false,
@@ -28,10 +42,17 @@ func jsonFormatter() log.Formatter {
 func run() error {
 	var parameters Parameters
 
-	flag.StringVar(&parameters.certFile, "cert", "./cert.pem", "File containing the x509 Certificate for HTTPS.")
-	flag.StringVar(&parameters.keyFile, "key", "./key.pem", "File containing the x509 private key to --tlsCertFile.")
+	flag.StringVar(&parameters.certFile, "cert", "./cert.pem", "File containing the x509 Certificate for HTTPS. Ignored when --webhook-name and --service-name are set.")
+	flag.StringVar(&parameters.keyFile, "key", "./key.pem", "File containing the x509 private key to --cert. Ignored when --webhook-name and --service-name are set.")
 	flag.StringVar(&parameters.LogFormat, "log-format", "text", "Log format, either 'json' or 'text'")
 	flag.StringVar(&parameters.LogLevel, "log-level", "info", "Logging verbosity level")
+	flag.StringVar(&parameters.sidecarConfigFile, "sidecar-config", "./sidecars.yaml", "File containing the injectable sidecar templates.")
+	injectionPolicy := flag.String("inject-policy", string(InjectionPolicyOptIn),
+		"Injection policy, either 'opt-in' (inject when annotated inject: \"true\") or 'opt-out' (inject everywhere except when annotated inject: \"false\")")
+	webhookName := flag.String("webhook-name", "", "Name of the MutatingWebhookConfiguration to keep in sync with the self-provisioned CA. Enables self-bootstrapping TLS together with --service-name.")
+	serviceName := flag.String("service-name", "", "Name of the Service fronting this webhook, used as the serving cert's SAN. Enables self-bootstrapping TLS together with --webhook-name.")
+	serviceNamespace := flag.String("service-namespace", os.Getenv("POD_NAMESPACE"), "Namespace the webhook runs in, defaults to $POD_NAMESPACE.")
+	certSecretName := flag.String("cert-secret-name", "remaw-webhook-tls", "Name of the Secret used to store the self-provisioned serving certificate.")
 	flag.Parse()
 
 	switch parameters.LogFormat {
@@ -49,9 +70,22 @@ func run() error {
 	}
 	log.SetLevel(logLevel)
 
-	pair, err := tls.LoadX509KeyPair(parameters.certFile, parameters.keyFile)
+	sidecarConfig, err := LoadSidecarConfig(parameters.sidecarConfigFile)
+	if err != nil {
+		return fmt.Errorf("failed to load sidecar config: %v", err)
+	}
+
+	policy := InjectionPolicy(*injectionPolicy)
+	if policy != InjectionPolicyOptIn && policy != InjectionPolicyOptOut {
+		return fmt.Errorf("inject-policy '%s' is not recognized", *injectionPolicy)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	tlsConfig, err := buildTLSConfig(ctx, parameters, *webhookName, *serviceName, *serviceNamespace, *certSecretName)
 	if err != nil {
-		return fmt.Errorf("failed to load key pair: %v", err)
+		return fmt.Errorf("while setting up TLS: %v", err)
 	}
 
 	go metrics.Serve(":8080", "/metrics", "/isReady", "/isAlive")
@@ -59,21 +93,80 @@ func run() error {
 	webhookServer := WebhookServer{
 		server: &http.Server{
 			Addr:      ":8443",
-			TLSConfig: &tls.Config{Certificates: []tls.Certificate{pair}},
+			TLSConfig: tlsConfig,
 		},
+		sidecarConfig:   sidecarConfig,
+		injectionPolicy: policy,
 	}
 
 	http.HandleFunc("/mutate", webhookServer.serve)
 
-	err = webhookServer.server.ListenAndServeTLS("", "")
-	if err != nil {
-		return fmt.Errorf("while starting server: %s", err)
+	serveErrors := make(chan error, 1)
+	go func() {
+		serveErrors <- webhookServer.server.ListenAndServeTLS("", "")
+	}()
+
+	select {
+	case err := <-serveErrors:
+		if err != nil && err != http.ErrServerClosed {
+			return fmt.Errorf("while starting server: %s", err)
+		}
+	case <-ctx.Done():
+		log.Info("Received shutdown signal, draining")
+		metrics.SetReady(false)
+		time.Sleep(drainDelay)
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := webhookServer.server.Shutdown(shutdownCtx); err != nil {
+			return fmt.Errorf("while shutting down server: %s", err)
+		}
+		<-serveErrors
 	}
 
 	log.Info("Shutting down cleanly")
 	return nil
 }
 
+// buildTLSConfig decides between the two supported ways of serving HTTPS: a
+// pre-provisioned cert/key pair on disk, or a self-bootstrapping CertManager
+// that provisions and rotates its own cert in-cluster.
+func buildTLSConfig(ctx context.Context, parameters Parameters, webhookName, serviceName, serviceNamespace, certSecretName string) (*tls.Config, error) {
+	if webhookName == "" && serviceName == "" {
+		pair, err := tls.LoadX509KeyPair(parameters.certFile, parameters.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load key pair: %v", err)
+		}
+		return &tls.Config{Certificates: []tls.Certificate{pair}}, nil
+	}
+
+	if webhookName == "" || serviceName == "" {
+		return nil, fmt.Errorf("--webhook-name and --service-name must be set together")
+	}
+	if serviceNamespace == "" {
+		return nil, fmt.Errorf("--service-namespace (or $POD_NAMESPACE) must be set when self-bootstrapping TLS")
+	}
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("while loading in-cluster config: %w", err)
+	}
+
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("while creating Kubernetes client: %w", err)
+	}
+
+	certManager := NewCertManager(clientset, serviceNamespace, certSecretName, serviceName, webhookName)
+	if err := certManager.Bootstrap(ctx); err != nil {
+		return nil, fmt.Errorf("while bootstrapping webhook TLS: %w", err)
+	}
+
+	go certManager.RunRotator(ctx)
+
+	return &tls.Config{GetCertificate: certManager.GetCertificate}, nil
+}
+
 func main() {
 	err := run()
 	if err != nil {
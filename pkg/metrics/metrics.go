@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// AdmissionResult categorizes how an AdmissionReview was handled, for the
+// admission request metrics below.
+type AdmissionResult string
+
+const (
+	ResultAllowed AdmissionResult = "allowed"
+	ResultDenied  AdmissionResult = "denied"
+	ResultMutated AdmissionResult = "mutated"
+	ResultError   AdmissionResult = "error"
+)
+
+var (
+	admissionRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "remaw_admission_requests_total",
+			Help: "Total number of admission requests handled, by result and GroupVersionKind.",
+		},
+		[]string{"result", "gvk"},
+	)
+
+	admissionRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "remaw_admission_request_duration_seconds",
+			Help:    "Latency of handling an admission request, by result and GroupVersionKind.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"result", "gvk"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(admissionRequestsTotal, admissionRequestDuration)
+}
+
+// ObserveAdmissionRequest records the outcome and latency of handling one
+// AdmissionReview.
+func ObserveAdmissionRequest(gvk string, result AdmissionResult, duration time.Duration) {
+	admissionRequestsTotal.WithLabelValues(string(result), gvk).Inc()
+	admissionRequestDuration.WithLabelValues(string(result), gvk).Observe(duration.Seconds())
+}
+
+// ready gates the isReady probe. It starts healthy and is flipped to
+// unhealthy while the webhook drains in-flight requests during shutdown, so
+// the API server stops sending new AdmissionReviews.
+var ready int32 = 1
+
+// SetReady flips the isReady probe's health.
+func SetReady(isReady bool) {
+	if isReady {
+		atomic.StoreInt32(&ready, 1)
+	} else {
+		atomic.StoreInt32(&ready, 0)
+	}
+}
+
+func isReadyHandler(w http.ResponseWriter, _ *http.Request) {
+	if atomic.LoadInt32(&ready) == 1 {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	http.Error(w, "draining", http.StatusServiceUnavailable)
+}
+
+func isAliveHandler(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// Serve starts an HTTP server exposing the Prometheus metrics endpoint and
+// the isReady/isAlive health probes. It blocks; callers typically run it in
+// its own goroutine.
+func Serve(addr, metricsPath, readyPath, alivePath string) {
+	http.Handle(metricsPath, promhttp.Handler())
+	http.HandleFunc(readyPath, isReadyHandler)
+	http.HandleFunc(alivePath, isAliveHandler)
+
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		log.Errorf("metrics server: %s", err)
+	}
+}
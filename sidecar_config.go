@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"text/template"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/yaml"
+)
+
+const defaultTemplateName = "default"
+
+// NamespaceSelector allow/deny-lists the namespaces the webhook considers.
+// Exclude is checked first: a namespace present in both lists is excluded.
+// An empty Include matches every namespace.
+type NamespaceSelector struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+func (s NamespaceSelector) Allows(namespace string) bool {
+	for _, excluded := range s.Exclude {
+		if excluded == namespace {
+			return false
+		}
+	}
+
+	if len(s.Include) == 0 {
+		return true
+	}
+
+	for _, included := range s.Include {
+		if included == namespace {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SidecarTemplate describes one injectable sidecar, as read from the sidecar
+// config file. Container is a text/template that renders to a corev1.Container
+// YAML document, so operators can reference pod fields (e.g. `{{ .ObjectMeta.Labels.app }}`)
+// when filling in things like the exporter's `-redis.addr` flag.
+type SidecarTemplate struct {
+	Container        string                        `json:"container"`
+	Volumes          []corev1.Volume               `json:"volumes,omitempty"`
+	InitContainers   []corev1.Container            `json:"initContainers,omitempty"`
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+}
+
+// SidecarConfig is the top-level shape of the sidecar config file, normally
+// mounted into the webhook's pod from a ConfigMap.
+type SidecarConfig struct {
+	Templates   map[string]SidecarTemplate `json:"templates"`
+	Namespaces  NamespaceSelector          `json:"namespaces,omitempty"`
+	PodSelector string                     `json:"podSelector,omitempty"`
+
+	podSelector labels.Selector
+}
+
+// PodSelectorMatches reports whether podLabels satisfy the configured
+// PodSelector. An empty PodSelector matches every pod.
+func (c *SidecarConfig) PodSelectorMatches(podLabels map[string]string) bool {
+	if c.podSelector == nil {
+		return true
+	}
+	return c.podSelector.Matches(labels.Set(podLabels))
+}
+
+// LoadSidecarConfig reads and parses the sidecar config file at path.
+func LoadSidecarConfig(path string) (*SidecarConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("while reading sidecar config %q: %w", path, err)
+	}
+
+	config := &SidecarConfig{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("while parsing sidecar config %q: %w", path, err)
+	}
+
+	if _, ok := config.Templates[defaultTemplateName]; !ok {
+		return nil, fmt.Errorf("sidecar config %q must define a %q template", path, defaultTemplateName)
+	}
+
+	if config.PodSelector != "" {
+		selector, err := labels.Parse(config.PodSelector)
+		if err != nil {
+			return nil, fmt.Errorf("while parsing podSelector %q: %w", config.PodSelector, err)
+		}
+		config.podSelector = selector
+	}
+
+	return config, nil
+}
+
+// Render executes the template's Container against pod and unmarshals the
+// result into a corev1.Container.
+func (t SidecarTemplate) Render(pod *corev1.Pod) (corev1.Container, error) {
+	tmpl, err := template.New("container").Parse(t.Container)
+	if err != nil {
+		return corev1.Container{}, fmt.Errorf("while parsing container template: %w", err)
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, pod); err != nil {
+		return corev1.Container{}, fmt.Errorf("while executing container template: %w", err)
+	}
+
+	var container corev1.Container
+	if err := yaml.Unmarshal(buf.Bytes(), &container); err != nil {
+		return corev1.Container{}, fmt.Errorf("while parsing rendered container: %w", err)
+	}
+
+	return container, nil
+}
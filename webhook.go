@@ -4,16 +4,21 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"k8s.io/api/admission/v1beta1"
-	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/resource"
-	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	jsonpatch "gomodules.xyz/jsonpatch/v3"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/serializer"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"remaw/pkg/metrics"
 )
 
 var (
@@ -21,113 +26,216 @@ var (
 	codecs        = serializer.NewCodecFactory(runtimeScheme)
 	deserializer  = codecs.UniversalDeserializer()
 	defaulter     = runtime.ObjectDefaulter(runtimeScheme)
+
+	admissionReviewGVKv1      = admissionv1.SchemeGroupVersion.WithKind("AdmissionReview")
+	admissionReviewGVKv1beta1 = admissionv1beta1.SchemeGroupVersion.WithKind("AdmissionReview")
 )
 
+func init() {
+	utilruntime.Must(admissionv1.AddToScheme(runtimeScheme))
+	utilruntime.Must(admissionv1beta1.AddToScheme(runtimeScheme))
+}
+
+const (
+	statusKey                 = "redis-exporter-sidecar.nais.io/status"
+	injectKey                 = "redis-exporter-sidecar.nais.io/inject"
+	templateKey               = "redis-exporter-sidecar.nais.io/template"
+	exporterPortKey           = "redis-exporter-sidecar.nais.io/port"
+	exporterAddrKey           = "redis-exporter-sidecar.nais.io/addr"
+	exporterPasswordSecretKey = "redis-exporter-sidecar.nais.io/password-secret"
+	prometheusScrapeKey       = "prometheus.io/scrape"
+	prometheusPortKey         = "prometheus.io/port"
+	prometheusPathKey         = "prometheus.io/path"
+)
+
+// InjectionPolicy controls whether a pod must opt in or opt out of sidecar
+// injection via the injectKey annotation.
+type InjectionPolicy string
+
 const (
-	exporterDockerImage = "oliver006/redis_exporter:v0.33.0-alpine"
-	statusKey           = "redis-exporter-sidecar.nais.io/status"
-	injectKey           = "redis-exporter-sidecar.nais.io/inject"
-	exporterPortKey     = "redis-exporter-sidecar.nais.io/port"
-	prometheusScrapeKey = "prometheus.io/scrape"
-	prometheusPortKey   = "prometheus.io/port"
-	prometheusPathKey   = "prometheus.io/path"
+	InjectionPolicyOptIn  InjectionPolicy = "opt-in"
+	InjectionPolicyOptOut InjectionPolicy = "opt-out"
 )
 
 type WebhookServer struct {
-	server *http.Server
+	server          *http.Server
+	sidecarConfig   *SidecarConfig
+	injectionPolicy InjectionPolicy
 }
 
 type Parameters struct {
-	certFile  string
-	keyFile   string
-	LogFormat string
-	LogLevel  string
+	certFile          string
+	keyFile           string
+	sidecarConfigFile string
+	LogFormat         string
+	LogLevel          string
 }
 
-type patchOperation struct {
-	Op    string      `json:"op"`
-	Path  string      `json:"path"`
-	Value interface{} `json:"value,omitempty"`
+func sidecarTemplateFor(config *SidecarConfig, annotations map[string]string) (SidecarTemplate, error) {
+	name := annotations[templateKey]
+	if name == "" {
+		name = defaultTemplateName
+	}
+
+	template, ok := config.Templates[name]
+	if !ok {
+		return SidecarTemplate{}, fmt.Errorf("no sidecar template named %q", name)
+	}
+
+	return template, nil
 }
 
-func getDefaultSidecar() corev1.Container {
-	return corev1.Container{
-		Name:            "exporter",
-		Image:           exporterDockerImage,
-		ImagePullPolicy: corev1.PullIfNotPresent,
-		Ports: []corev1.ContainerPort{
-			{
-				ContainerPort: int32(9121),
-				Name:          "http",
-				Protocol:      corev1.ProtocolTCP,
-			},
-		},
-		Resources: corev1.ResourceRequirements{
-			Requests: corev1.ResourceList{
-				corev1.ResourceCPU:    resource.MustParse("100m"),
-				corev1.ResourceMemory: resource.MustParse("100Mi"),
-			},
-			Limits: corev1.ResourceList{
-				corev1.ResourceCPU:    resource.MustParse("100m"),
-				corev1.ResourceMemory: resource.MustParse("100Mi"),
+// applyPodOverrides adjusts the rendered exporter container according to the
+// per-pod redis-exporter-sidecar.nais.io/{port,addr,password-secret}
+// annotations, and returns the exporter port the container ends up
+// listening on (empty if none was set and the template didn't declare one).
+// It returns an error if exporterPortKey is set to something other than a
+// valid TCP port number.
+func applyPodOverrides(annotations map[string]string, container *corev1.Container) (string, error) {
+	port := annotations[exporterPortKey]
+	if port != "" {
+		containerPort, err := strconv.Atoi(port)
+		if err != nil || containerPort < 1 || containerPort > 65535 {
+			return "", fmt.Errorf("invalid %s annotation %q: must be a valid port number", exporterPortKey, port)
+		}
+		container.Args = append(container.Args, fmt.Sprintf("--web.listen-address=:%s", port))
+		if len(container.Ports) > 0 {
+			container.Ports[0].ContainerPort = int32(containerPort)
+		}
+	}
+
+	if addr := annotations[exporterAddrKey]; addr != "" {
+		container.Args = append(container.Args, fmt.Sprintf("--redis.addr=%s", addr))
+	}
+
+	if secretName := annotations[exporterPasswordSecretKey]; secretName != "" {
+		container.Env = append(container.Env, corev1.EnvVar{
+			Name: "REDIS_PASSWORD",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: secretName},
+					Key:                  "password",
+				},
 			},
-		},
+		})
 	}
-}
 
-func addSidecar() patchOperation {
-	return patchOperation{
-		Op:    "add",
-		Path:  "/spec/containers/-",
-		Value: getDefaultSidecar(),
+	if port != "" {
+		return port, nil
+	}
+	if len(container.Ports) > 0 {
+		return strconv.Itoa(int(container.Ports[0].ContainerPort)), nil
 	}
+	return "", nil
 }
 
-func updateAnnotation(target map[string]string) patchOperation {
-	if target == nil || target[injectKey] == "" {
-		target = map[string]string{}
-		return patchOperation{
-			Op:   "add",
-			Path: "/metadata/annotations",
-			Value: map[string]string{
-				injectKey:           "injected",
-				prometheusScrapeKey: "true",
-				prometheusPortKey:   "",
-				prometheusPathKey:   "/metrics",
-			},
-		}
+// applyInjection mutates pod in place: it appends the rendered sidecar
+// container, the template's volumes/initContainers/imagePullSecrets, and
+// stamps the annotations that mark the pod as injected.
+func applyInjection(config *SidecarConfig, pod *corev1.Pod) error {
+	sidecarTemplate, err := sidecarTemplateFor(config, pod.Annotations)
+	if err != nil {
+		return err
 	}
 
-	return patchOperation{
-		Op:    "replace",
-		Path:  "/metadata/annotations/" + injectKey,
-		Value: "injected",
+	container, err := sidecarTemplate.Render(pod)
+	if err != nil {
+		return err
 	}
+
+	exporterPort, err := applyPodOverrides(pod.Annotations, &container)
+	if err != nil {
+		return err
+	}
+
+	pod.Spec.Containers = append(pod.Spec.Containers, container)
+	pod.Spec.Volumes = append(pod.Spec.Volumes, sidecarTemplate.Volumes...)
+	pod.Spec.InitContainers = append(pod.Spec.InitContainers, sidecarTemplate.InitContainers...)
+	pod.Spec.ImagePullSecrets = append(pod.Spec.ImagePullSecrets, sidecarTemplate.ImagePullSecrets...)
+
+	if pod.Annotations == nil {
+		pod.Annotations = map[string]string{}
+	}
+	pod.Annotations[injectKey] = "injected"
+	pod.Annotations[statusKey] = "injected"
+	pod.Annotations[prometheusScrapeKey] = "true"
+	pod.Annotations[prometheusPathKey] = "/metrics"
+	pod.Annotations[prometheusPortKey] = exporterPort
+
+	return nil
 }
 
-func createPatch(pod *corev1.Pod) ([]byte, error) {
-	var patch []patchOperation
-	patch = append(patch, addSidecar())
-	patch = append(patch, updateAnnotation(pod.Annotations))
+// createPatch diffs the pod as it is against the pod as it would look after
+// injection, and returns the resulting RFC 6902 JSON patch. Computing the
+// patch this way, rather than hand-building ops, keeps createPatch correct
+// as applyInjection grows more kinds of mutations.
+func createPatch(config *SidecarConfig, pod *corev1.Pod) ([]byte, error) {
+	original, err := json.Marshal(pod)
+	if err != nil {
+		return nil, fmt.Errorf("while marshaling original pod: %w", err)
+	}
+
+	mutated := pod.DeepCopy()
+	if err := applyInjection(config, mutated); err != nil {
+		return nil, err
+	}
+
+	mutatedBytes, err := json.Marshal(mutated)
+	if err != nil {
+		return nil, fmt.Errorf("while marshaling mutated pod: %w", err)
+	}
+
+	patch, err := jsonpatch.CreatePatch(original, mutatedBytes)
+	if err != nil {
+		return nil, fmt.Errorf("while computing json patch: %w", err)
+	}
+
 	return json.Marshal(patch)
 }
 
-func mutationRequired(metadata *metav1.ObjectMeta) bool {
-	annotations := metadata.GetAnnotations()
-	if annotations == nil {
+// mutationRequired decides whether pod should be injected, by checking the
+// configured namespace/label selectors and then the injectKey annotation
+// against the server's InjectionPolicy.
+func (server *WebhookServer) mutationRequired(pod *corev1.Pod) bool {
+	metadata := &pod.ObjectMeta
+
+	if !server.sidecarConfig.Namespaces.Allows(metadata.Namespace) {
+		log.Infof("Mutation policy for %v/%v: namespace not selected", metadata.Namespace, metadata.Name)
+		return false
+	}
+
+	if !server.sidecarConfig.PodSelectorMatches(metadata.GetLabels()) {
+		log.Infof("Mutation policy for %v/%v: pod labels not selected", metadata.Namespace, metadata.Name)
 		return false
 	}
 
+	annotations := metadata.GetAnnotations()
 	status := annotations[statusKey]
-	var required bool
 	if strings.ToLower(status) == "injected" {
-		required = false;
-	} else {
-		switch strings.ToLower(annotations[injectKey]) {
-		default:
+		log.Infof("Mutation policy for %v/%v: status: %q required:false", metadata.Namespace, metadata.Name, status)
+		return false
+	}
+
+	inject := strings.ToLower(annotations[injectKey])
+	if inject == "injected" {
+		log.Infof("Mutation policy for %v/%v: inject: %q required:false", metadata.Namespace, metadata.Name, inject)
+		return false
+	}
+
+	var required bool
+	if server.injectionPolicy == InjectionPolicyOptOut {
+		switch inject {
+		case "n", "no", "false", "off":
 			required = false
+		default:
+			required = true
+		}
+	} else {
+		switch inject {
 		case "y", "yes", "true", "on":
 			required = true
+		default:
+			required = false
 		}
 	}
 
@@ -135,46 +243,105 @@ func mutationRequired(metadata *metav1.ObjectMeta) bool {
 	return required
 }
 
-func (server *WebhookServer) mutate(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
-	request := ar.Request
+// mutate runs the injection decision and patch computation for one
+// AdmissionRequest. result is always one of the metrics.Result* values, so
+// callers can record it regardless of outcome.
+func (server *WebhookServer) mutate(request *admissionv1.AdmissionRequest) (response *admissionv1.AdmissionResponse, result metrics.AdmissionResult) {
+	if request == nil {
+		log.Error("AdmissionReview has no request")
+		return &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: "admission review has no request",
+			},
+		}, metrics.ResultError
+	}
+
+	requestLog := log.WithFields(log.Fields{
+		"uid":       request.UID,
+		"namespace": request.Namespace,
+		"name":      request.Name,
+	})
+
 	var pod corev1.Pod
 	err := json.Unmarshal(request.Object.Raw, &pod)
 	if err != nil {
-		log.Errorf("Couldn't unmarshal raw pod object: %v", err)
-		return &v1beta1.AdmissionResponse{
+		requestLog.Errorf("Couldn't unmarshal raw pod object: %v", err)
+		return &admissionv1.AdmissionResponse{
 			Result: &metav1.Status{
 				Message: err.Error(),
 			},
-		}
+		}, metrics.ResultError
 	}
 
-	log.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v",
-		request.Kind, request.Namespace, request.Name, pod.Name, request.UID, request.Operation, request.UserInfo)
+	requestLog.Infof("AdmissionReview for Kind=%v Name=%v (%v) Operation=%v UserInfo=%v",
+		request.Kind, request.Name, pod.Name, request.Operation, request.UserInfo)
 
-	if !mutationRequired(&pod.ObjectMeta) {
-		log.Info("Skipping mutation for %s/%s due to policy check", pod.Namespace, pod.Name)
-		return &v1beta1.AdmissionResponse{
+	if !server.mutationRequired(&pod) {
+		requestLog.Infof("Skipping mutation for %s/%s due to policy check", pod.Namespace, pod.Name)
+		return &admissionv1.AdmissionResponse{
 			Allowed: true,
-		}
+		}, metrics.ResultAllowed
 	}
 
-	patchBytes, err := createPatch(&pod)
+	patchBytes, err := createPatch(server.sidecarConfig, &pod)
 	if err != nil {
-		return &v1beta1.AdmissionResponse{
+		requestLog.Errorf("Couldn't create patch: %v", err)
+		return &admissionv1.AdmissionResponse{
 			Result: &metav1.Status{
 				Message: err.Error(),
 			},
-		}
+		}, metrics.ResultError
 	}
 
-	log.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
-	return &v1beta1.AdmissionResponse{
+	requestLog.Infof("AdmissionResponse: patch=%v", string(patchBytes))
+	return &admissionv1.AdmissionResponse{
 		Allowed: true,
 		Patch:   patchBytes,
-		PatchType: func() *v1beta1.PatchType {
-			pt := v1beta1.PatchTypeJSONPatch
+		PatchType: func() *admissionv1.PatchType {
+			pt := admissionv1.PatchTypeJSONPatch
 			return &pt
 		}(),
+	}, metrics.ResultMutated
+}
+
+// v1beta1RequestToV1 converts a v1beta1 AdmissionRequest into its v1 equivalent so that
+// mutate only has to deal with one shape regardless of which API version the caller speaks.
+func v1beta1RequestToV1(in *admissionv1beta1.AdmissionRequest) *admissionv1.AdmissionRequest {
+	if in == nil {
+		return nil
+	}
+	return &admissionv1.AdmissionRequest{
+		UID:                in.UID,
+		Kind:               in.Kind,
+		Resource:           in.Resource,
+		SubResource:        in.SubResource,
+		RequestKind:        in.RequestKind,
+		RequestResource:    in.RequestResource,
+		RequestSubResource: in.RequestSubResource,
+		Name:               in.Name,
+		Namespace:          in.Namespace,
+		Operation:          admissionv1.Operation(in.Operation),
+		UserInfo:           in.UserInfo,
+		Object:             in.Object,
+		OldObject:          in.OldObject,
+		DryRun:             in.DryRun,
+		Options:            in.Options,
+	}
+}
+
+// v1ResponseToV1beta1 converts a v1 AdmissionResponse back into v1beta1 for callers that
+// only understand the older API version.
+func v1ResponseToV1beta1(in *admissionv1.AdmissionResponse) *admissionv1beta1.AdmissionResponse {
+	if in == nil {
+		return nil
+	}
+	return &admissionv1beta1.AdmissionResponse{
+		UID:              in.UID,
+		Allowed:          in.Allowed,
+		Result:           in.Result,
+		Patch:            in.Patch,
+		PatchType:        (*admissionv1beta1.PatchType)(in.PatchType),
+		AuditAnnotations: in.AuditAnnotations,
 	}
 }
 
@@ -199,28 +366,59 @@ func (server *WebhookServer) serve(responseWriter http.ResponseWriter, request *
 		return
 	}
 
-	var admissionResponse *v1beta1.AdmissionResponse
-	ar := v1beta1.AdmissionReview{}
-	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
+	obj, gvk, err := deserializer.Decode(body, nil, nil)
+	if err != nil {
 		log.Errorf("Can't decode body: %v", err)
-		admissionResponse = &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
-		}
-	} else {
-		admissionResponse = server.mutate(&ar)
+		http.Error(responseWriter, fmt.Sprintf("could not decode body: %v", err), http.StatusBadRequest)
+		return
 	}
 
-	admissionReview := v1beta1.AdmissionReview{}
-	if admissionResponse != nil {
-		admissionReview.Response = admissionResponse
-		if ar.Request != nil {
-			admissionReview.Response.UID = ar.Request.UID
+	start := time.Now()
+	var responseObj runtime.Object
+	var result metrics.AdmissionResult
+	switch *gvk {
+	case admissionReviewGVKv1:
+		requestedAdmissionReview, ok := obj.(*admissionv1.AdmissionReview)
+		if !ok {
+			log.Errorf("Expected v1.AdmissionReview, got: %T", obj)
+			http.Error(responseWriter, "expected v1.AdmissionReview", http.StatusBadRequest)
+			return
 		}
+		var admissionResponse *admissionv1.AdmissionResponse
+		admissionResponse, result = server.mutate(requestedAdmissionReview.Request)
+		if requestedAdmissionReview.Request != nil {
+			admissionResponse.UID = requestedAdmissionReview.Request.UID
+		}
+		response := admissionv1.AdmissionReview{}
+		response.SetGroupVersionKind(*gvk)
+		response.Response = admissionResponse
+		responseObj = &response
+
+	case admissionReviewGVKv1beta1:
+		requestedAdmissionReview, ok := obj.(*admissionv1beta1.AdmissionReview)
+		if !ok {
+			log.Errorf("Expected v1beta1.AdmissionReview, got: %T", obj)
+			http.Error(responseWriter, "expected v1beta1.AdmissionReview", http.StatusBadRequest)
+			return
+		}
+		var admissionResponse *admissionv1.AdmissionResponse
+		admissionResponse, result = server.mutate(v1beta1RequestToV1(requestedAdmissionReview.Request))
+		if requestedAdmissionReview.Request != nil {
+			admissionResponse.UID = requestedAdmissionReview.Request.UID
+		}
+		response := admissionv1beta1.AdmissionReview{}
+		response.SetGroupVersionKind(*gvk)
+		response.Response = v1ResponseToV1beta1(admissionResponse)
+		responseObj = &response
+
+	default:
+		log.Errorf("Unsupported GroupVersionKind: %v", gvk)
+		http.Error(responseWriter, fmt.Sprintf("unsupported GroupVersionKind %v", gvk), http.StatusBadRequest)
+		return
 	}
+	metrics.ObserveAdmissionRequest(gvk.String(), result, time.Since(start))
 
-	resp, err := json.Marshal(admissionReview)
+	resp, err := json.Marshal(responseObj)
 	if err != nil {
 		log.Errorf("Can't encode response: %v", err)
 		http.Error(responseWriter, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jsonpatch2 "github.com/evanphx/json-patch"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"remaw/pkg/metrics"
+)
+
+func testSidecarConfig() *SidecarConfig {
+	return &SidecarConfig{
+		Templates: map[string]SidecarTemplate{
+			defaultTemplateName: {
+				Container: "name: exporter\n" +
+					"image: oliver006/redis_exporter:v0.33.0-alpine\n" +
+					"ports:\n" +
+					"  - name: http\n" +
+					"    containerPort: 9121\n" +
+					"    protocol: TCP\n",
+			},
+		},
+	}
+}
+
+func testServer() *WebhookServer {
+	return &WebhookServer{
+		sidecarConfig:   testSidecarConfig(),
+		injectionPolicy: InjectionPolicyOptIn,
+	}
+}
+
+func podFixture(annotations map[string]string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "redis",
+			Namespace:   "default",
+			Annotations: annotations,
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "redis", Image: "redis:6"},
+			},
+		},
+	}
+}
+
+func admissionReviewV1(t *testing.T, pod *corev1.Pod) []byte {
+	t.Helper()
+
+	podBytes, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatalf("marshal pod: %v", err)
+	}
+
+	review := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       types.UID("test-uid"),
+			Namespace: pod.Namespace,
+			Name:      pod.Name,
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Object:    runtime.RawExtension{Raw: podBytes},
+		},
+	}
+
+	reviewBytes, err := json.Marshal(review)
+	if err != nil {
+		t.Fatalf("marshal admission review: %v", err)
+	}
+	return reviewBytes
+}
+
+func admissionReviewV1beta1(t *testing.T, pod *corev1.Pod) []byte {
+	t.Helper()
+
+	podBytes, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatalf("marshal pod: %v", err)
+	}
+
+	review := admissionv1beta1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1beta1", Kind: "AdmissionReview"},
+		Request: &admissionv1beta1.AdmissionRequest{
+			UID:       types.UID("test-uid"),
+			Namespace: pod.Namespace,
+			Name:      pod.Name,
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Object:    runtime.RawExtension{Raw: podBytes},
+		},
+	}
+
+	reviewBytes, err := json.Marshal(review)
+	if err != nil {
+		t.Fatalf("marshal admission review: %v", err)
+	}
+	return reviewBytes
+}
+
+func postAdmissionReview(t *testing.T, client *http.Client, url string, body []byte) *http.Response {
+	t.Helper()
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST %s: %v", url, err)
+	}
+	return resp
+}
+
+func TestServeMutatesPodsAccordingToPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		wantPatched bool
+	}{
+		{"no annotations", nil, false},
+		{"opt-in annotation", map[string]string{injectKey: "true"}, true},
+		{"already injected", map[string]string{injectKey: "injected", statusKey: "injected"}, false},
+	}
+
+	reviewBuilders := map[string]func(*testing.T, *corev1.Pod) []byte{
+		"v1":      admissionReviewV1,
+		"v1beta1": admissionReviewV1beta1,
+	}
+
+	for gvkName, buildReview := range reviewBuilders {
+		for _, tt := range tests {
+			t.Run(gvkName+"/"+tt.name, func(t *testing.T) {
+				server := testServer()
+				ts := httptest.NewTLSServer(http.HandlerFunc(server.serve))
+				defer ts.Close()
+
+				pod := podFixture(tt.annotations)
+				reviewBody := buildReview(t, pod)
+
+				resp := postAdmissionReview(t, ts.Client(), ts.URL+"/mutate", reviewBody)
+				defer resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("status = %d, want 200", resp.StatusCode)
+				}
+
+				respBody, err := ioutil.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatalf("read response: %v", err)
+				}
+
+				var allowed bool
+				var patch []byte
+				switch gvkName {
+				case "v1":
+					var review admissionv1.AdmissionReview
+					if err := json.Unmarshal(respBody, &review); err != nil {
+						t.Fatalf("unmarshal response: %v", err)
+					}
+					allowed = review.Response.Allowed
+					patch = review.Response.Patch
+				case "v1beta1":
+					var review admissionv1beta1.AdmissionReview
+					if err := json.Unmarshal(respBody, &review); err != nil {
+						t.Fatalf("unmarshal response: %v", err)
+					}
+					allowed = review.Response.Allowed
+					patch = review.Response.Patch
+				}
+
+				if !allowed {
+					t.Fatalf("expected Allowed=true")
+				}
+
+				if !tt.wantPatched {
+					if len(patch) != 0 {
+						t.Fatalf("expected no patch, got %s", patch)
+					}
+					return
+				}
+
+				if len(patch) == 0 {
+					t.Fatalf("expected a patch, got none")
+				}
+
+				podBytes, err := json.Marshal(pod)
+				if err != nil {
+					t.Fatalf("marshal original pod: %v", err)
+				}
+
+				decodedPatch, err := jsonpatch2.DecodePatch(patch)
+				if err != nil {
+					t.Fatalf("decode patch: %v", err)
+				}
+
+				mutatedBytes, err := decodedPatch.Apply(podBytes)
+				if err != nil {
+					t.Fatalf("apply patch: %v", err)
+				}
+
+				var mutated corev1.Pod
+				if err := json.Unmarshal(mutatedBytes, &mutated); err != nil {
+					t.Fatalf("unmarshal mutated pod: %v", err)
+				}
+
+				if len(mutated.Spec.Containers) != 2 {
+					t.Fatalf("expected 2 containers after injection, got %d", len(mutated.Spec.Containers))
+				}
+				if mutated.Annotations[injectKey] != "injected" {
+					t.Fatalf("expected %s to be 'injected', got %q", injectKey, mutated.Annotations[injectKey])
+				}
+				if mutated.Annotations[statusKey] != "injected" {
+					t.Fatalf("expected %s to be 'injected', got %q", statusKey, mutated.Annotations[statusKey])
+				}
+				if mutated.Annotations[prometheusPortKey] != "9121" {
+					t.Fatalf("expected %s to be '9121', got %q", prometheusPortKey, mutated.Annotations[prometheusPortKey])
+				}
+			})
+		}
+	}
+}
+
+func TestServeRejectsEmptyBody(t *testing.T) {
+	server := testServer()
+	ts := httptest.NewTLSServer(http.HandlerFunc(server.serve))
+	defer ts.Close()
+
+	resp := postAdmissionReview(t, ts.Client(), ts.URL+"/mutate", nil)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestServeRejectsWrongContentType(t *testing.T) {
+	server := testServer()
+	ts := httptest.NewTLSServer(http.HandlerFunc(server.serve))
+	defer ts.Close()
+
+	resp, err := ts.Client().Post(ts.URL+"/mutate", "text/plain", bytes.NewReader([]byte("{}")))
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusUnsupportedMediaType)
+	}
+}
+
+func TestServeRejectsMalformedAdmissionReview(t *testing.T) {
+	server := testServer()
+	ts := httptest.NewTLSServer(http.HandlerFunc(server.serve))
+	defer ts.Close()
+
+	resp := postAdmissionReview(t, ts.Client(), ts.URL+"/mutate", []byte("not json"))
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestServeReturnsAdmissionErrorForUnparsablePod(t *testing.T) {
+	server := testServer()
+	ts := httptest.NewTLSServer(http.HandlerFunc(server.serve))
+	defer ts.Close()
+
+	review := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:    types.UID("test-uid"),
+			Object: runtime.RawExtension{Raw: []byte(`{"metadata":{"annotations":5}}`)},
+		},
+	}
+	reviewBody, err := json.Marshal(review)
+	if err != nil {
+		t.Fatalf("marshal admission review: %v", err)
+	}
+
+	resp := postAdmissionReview(t, ts.Client(), ts.URL+"/mutate", reviewBody)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+
+	var respReview admissionv1.AdmissionReview
+	if err := json.Unmarshal(respBody, &respReview); err != nil {
+		t.Fatalf("unmarshal response: %v", err)
+	}
+
+	if respReview.Response.Allowed {
+		t.Fatalf("expected Allowed=false for an unparsable pod object")
+	}
+	if respReview.Response.Result == nil {
+		t.Fatalf("expected a Result explaining the unmarshal error")
+	}
+}
+
+func TestMutationRequiredSkipsAlreadyInjectedPods(t *testing.T) {
+	server := testServer()
+	pod := podFixture(map[string]string{
+		injectKey: "injected",
+		statusKey: "injected",
+	})
+
+	if server.mutationRequired(pod) {
+		t.Fatalf("expected an already-injected pod to be skipped")
+	}
+}
+
+func TestMutationRequiredRequiresOptInAnnotation(t *testing.T) {
+	server := testServer()
+
+	if server.mutationRequired(podFixture(nil)) {
+		t.Fatalf("expected a pod with no annotations to be skipped under opt-in policy")
+	}
+
+	if !server.mutationRequired(podFixture(map[string]string{injectKey: "true"})) {
+		t.Fatalf("expected an opt-in annotated pod to require injection")
+	}
+}
+
+func TestMutationRequiredOptOutPolicy(t *testing.T) {
+	server := testServer()
+	server.injectionPolicy = InjectionPolicyOptOut
+
+	if !server.mutationRequired(podFixture(nil)) {
+		t.Fatalf("expected a pod with no annotations to require injection under opt-out policy")
+	}
+
+	if server.mutationRequired(podFixture(map[string]string{injectKey: "false"})) {
+		t.Fatalf("expected an opt-out annotated pod to be skipped")
+	}
+
+	if server.mutationRequired(podFixture(map[string]string{injectKey: "injected"})) {
+		t.Fatalf("expected an already-injected pod to be skipped under opt-out policy, even without statusKey set")
+	}
+}
+
+func TestMutationRequiredNamespaceSelector(t *testing.T) {
+	server := testServer()
+	server.injectionPolicy = InjectionPolicyOptOut
+	server.sidecarConfig.Namespaces = NamespaceSelector{Exclude: []string{"default"}}
+
+	if server.mutationRequired(podFixture(nil)) {
+		t.Fatalf("expected a pod in an excluded namespace to be skipped")
+	}
+
+	server.sidecarConfig.Namespaces = NamespaceSelector{Include: []string{"other"}}
+	if server.mutationRequired(podFixture(nil)) {
+		t.Fatalf("expected a pod outside the included namespaces to be skipped")
+	}
+}
+
+func TestMutationRequiredPodSelector(t *testing.T) {
+	server := testServer()
+	server.injectionPolicy = InjectionPolicyOptOut
+
+	selector, err := labels.Parse("app=redis")
+	if err != nil {
+		t.Fatalf("parse selector: %v", err)
+	}
+	server.sidecarConfig.PodSelector = "app=redis"
+	server.sidecarConfig.podSelector = selector
+
+	pod := podFixture(nil)
+	if server.mutationRequired(pod) {
+		t.Fatalf("expected a pod without matching labels to be skipped")
+	}
+
+	pod.Labels = map[string]string{"app": "redis"}
+	if !server.mutationRequired(pod) {
+		t.Fatalf("expected a pod with matching labels to require injection")
+	}
+}
+
+func TestMutateNilRequest(t *testing.T) {
+	server := testServer()
+
+	response, result := server.mutate(nil)
+	if response.Allowed {
+		t.Fatalf("expected Allowed=false for a nil admission request")
+	}
+	if response.Result == nil {
+		t.Fatalf("expected a Result explaining the missing request")
+	}
+	if result != metrics.ResultError {
+		t.Fatalf("expected result %v, got %v", metrics.ResultError, result)
+	}
+}
+
+func exporterContainerFixture() corev1.Container {
+	return corev1.Container{
+		Name:  "exporter",
+		Image: "oliver006/redis_exporter:v0.33.0-alpine",
+		Ports: []corev1.ContainerPort{
+			{Name: "http", ContainerPort: 9121, Protocol: corev1.ProtocolTCP},
+		},
+	}
+}
+
+func TestApplyPodOverridesSetsPortAddrAndPasswordSecret(t *testing.T) {
+	container := exporterContainerFixture()
+
+	port, err := applyPodOverrides(map[string]string{
+		exporterPortKey:           "9200",
+		exporterAddrKey:           "redis:6379",
+		exporterPasswordSecretKey: "redis-creds",
+	}, &container)
+	if err != nil {
+		t.Fatalf("applyPodOverrides: %v", err)
+	}
+
+	if port != "9200" {
+		t.Fatalf("expected port %q, got %q", "9200", port)
+	}
+	if container.Ports[0].ContainerPort != 9200 {
+		t.Fatalf("expected container port 9200, got %d", container.Ports[0].ContainerPort)
+	}
+	if !containsArg(container.Args, "--web.listen-address=:9200") {
+		t.Fatalf("expected args to contain --web.listen-address=:9200, got %v", container.Args)
+	}
+	if !containsArg(container.Args, "--redis.addr=redis:6379") {
+		t.Fatalf("expected args to contain --redis.addr=redis:6379, got %v", container.Args)
+	}
+	if len(container.Env) != 1 || container.Env[0].ValueFrom.SecretKeyRef.Name != "redis-creds" {
+		t.Fatalf("expected REDIS_PASSWORD to be sourced from secret %q, got %+v", "redis-creds", container.Env)
+	}
+}
+
+func TestApplyPodOverridesDefaultsPortToTemplateWhenUnset(t *testing.T) {
+	container := exporterContainerFixture()
+
+	port, err := applyPodOverrides(nil, &container)
+	if err != nil {
+		t.Fatalf("applyPodOverrides: %v", err)
+	}
+	if port != "9121" {
+		t.Fatalf("expected the template's declared port %q, got %q", "9121", port)
+	}
+}
+
+func TestApplyPodOverridesRejectsInvalidPort(t *testing.T) {
+	for _, port := range []string{"abc", "-1", "70000", "0"} {
+		container := exporterContainerFixture()
+		if _, err := applyPodOverrides(map[string]string{exporterPortKey: port}, &container); err == nil {
+			t.Fatalf("expected an error for invalid port %q", port)
+		}
+	}
+}
+
+func containsArg(args []string, want string) bool {
+	for _, arg := range args {
+		if arg == want {
+			return true
+		}
+	}
+	return false
+}